@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	// ErrRateLimited is returned when a client is requesting new sessions
+	// faster than AdmissionLimits.SessionsPerSecond allows.
+	ErrRateLimited = errors.New("too many session requests")
+
+	// ErrFairShareExceeded is returned when admitting the session would push
+	// a GPU over its configured memory or session-count fair-share quota.
+	ErrFairShareExceeded = errors.New("GPU fair-share quota exceeded")
+)
+
+// AdmissionLimits configures the agent's per-client and per-GPU admission
+// policy. A zero value for any field disables that check.
+type AdmissionLimits struct {
+	SessionsPerSecond  float64
+	SessionBurst       int
+	MaxSessionsPerGpu  int
+	MaxGpuMemoryPerGpu uint64
+}
+
+type gpuUsage struct {
+	sessions uint32
+	memory   uint64
+}
+
+// AdmissionController tracks per-client session request rate and per-GPU
+// fair-share usage, and is consulted by requestSessionEp before a session is
+// allowed onto the agent.
+type AdmissionController struct {
+	limits AdmissionLimits
+
+	clientLimiters *utilities.ConcurrentMap[string, *rate.Limiter]
+
+	// gpuUsage and its entries are guarded by mutex rather than relying on
+	// ConcurrentMap's own locking: Allow's quota check and the usage update
+	// it guards must happen as a single atomic step across every pciId in
+	// the request, not as independent per-key operations.
+	mutex    sync.Mutex
+	gpuUsage map[string]*gpuUsage
+}
+
+func NewAdmissionController(limits AdmissionLimits) *AdmissionController {
+	return &AdmissionController{
+		limits:         limits,
+		clientLimiters: utilities.NewConcurrentMap[string, *rate.Limiter](),
+		gpuUsage:       make(map[string]*gpuUsage),
+	}
+}
+
+// usageFor returns pciId's usage entry, creating it if needed. Callers must
+// hold admission.mutex.
+func (admission *AdmissionController) usageFor(pciId string) *gpuUsage {
+	usage, found := admission.gpuUsage[pciId]
+	if !found {
+		usage = &gpuUsage{}
+		admission.gpuUsage[pciId] = usage
+	}
+	return usage
+}
+
+func (admission *AdmissionController) clientLimiter(clientId string) *rate.Limiter {
+	limiter, found := admission.clientLimiters.Get(clientId)
+	if !found {
+		limiter = rate.NewLimiter(rate.Limit(admission.limits.SessionsPerSecond), admission.limits.SessionBurst)
+		admission.clientLimiters.Set(clientId, limiter)
+	}
+	return limiter
+}
+
+// Allow checks clientId's request rate and the fair-share quota of the GPUs
+// requestSession would consume, returning the specific error and a
+// Retry-After duration when the caller should back off.
+func (admission *AdmissionController) Allow(clientId string, pciIds []string, memoryPerGpu uint64) (error, time.Duration) {
+	if admission.limits.SessionsPerSecond > 0 {
+		limiter := admission.clientLimiter(clientId)
+		if !limiter.Allow() {
+			prometheus.IncAdmissionRejected("rate_limited")
+
+			// Reserve just to compute how long the caller should wait, then
+			// give the token back immediately - otherwise every rejected
+			// request would permanently consume a reservation on top of the
+			// one Allow already declined.
+			reservation := limiter.Reserve()
+			delay := reservation.Delay()
+			reservation.Cancel()
+
+			return ErrRateLimited, delay
+		}
+	}
+
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+
+	for _, pciId := range pciIds {
+		usage := admission.usageFor(pciId)
+
+		if admission.limits.MaxSessionsPerGpu > 0 && int(usage.sessions)+1 > admission.limits.MaxSessionsPerGpu {
+			prometheus.IncAdmissionRejected("gpu_session_limit")
+			return ErrFairShareExceeded, 0
+		}
+
+		if admission.limits.MaxGpuMemoryPerGpu > 0 && usage.memory+memoryPerGpu > admission.limits.MaxGpuMemoryPerGpu {
+			prometheus.IncAdmissionRejected("gpu_memory_limit")
+			return ErrFairShareExceeded, 0
+		}
+	}
+
+	for _, pciId := range pciIds {
+		usage := admission.usageFor(pciId)
+		usage.sessions++
+		usage.memory += memoryPerGpu
+	}
+
+	return nil, 0
+}
+
+// Release gives back the fair-share quota consumed by a session that has
+// ended, so future Allow calls see the freed capacity.
+func (admission *AdmissionController) Release(pciIds []string, memoryPerGpu uint64) {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+
+	for _, pciId := range pciIds {
+		usage, found := admission.gpuUsage[pciId]
+		if found {
+			if usage.sessions > 0 {
+				usage.sessions--
+			}
+			if usage.memory >= memoryPerGpu {
+				usage.memory -= memoryPerGpu
+			}
+		}
+	}
+}
+
+// clientIdentity picks the identity Allow should rate-limit on: the verified
+// auth identity when present, falling back to the remote IP with its
+// ephemeral port stripped off - otherwise every connection from the same
+// client would look like a distinct, unlimited caller.
+func clientIdentity(identity string, remoteAddr string) string {
+	if identity != "" {
+		return identity
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
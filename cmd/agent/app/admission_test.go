@@ -0,0 +1,54 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import "testing"
+
+func TestAdmissionControllerReleaseFreesQuota(t *testing.T) {
+	admission := NewAdmissionController(AdmissionLimits{
+		MaxSessionsPerGpu: 1,
+	})
+
+	pciIds := []string{"0000:00:1e.0"}
+
+	if err, _ := admission.Allow("client", pciIds, 0); err != nil {
+		t.Fatalf("first Allow: unexpected error %v", err)
+	}
+
+	if err, _ := admission.Allow("client", pciIds, 0); err != ErrFairShareExceeded {
+		t.Fatalf("second Allow before Release: got %v, want ErrFairShareExceeded", err)
+	}
+
+	admission.Release(pciIds, 0)
+
+	if err, _ := admission.Allow("client", pciIds, 0); err != nil {
+		t.Fatalf("Allow after Release: unexpected error %v", err)
+	}
+}
+
+func TestAdmissionControllerAllowEnforcesGpuMemoryQuota(t *testing.T) {
+	admission := NewAdmissionController(AdmissionLimits{
+		MaxGpuMemoryPerGpu: 100,
+	})
+
+	pciIds := []string{"0000:00:1e.0"}
+
+	if err, _ := admission.Allow("client", pciIds, 60); err != nil {
+		t.Fatalf("first Allow: unexpected error %v", err)
+	}
+
+	if err, _ := admission.Allow("client", pciIds, 60); err != ErrFairShareExceeded {
+		t.Fatalf("second Allow: got %v, want ErrFairShareExceeded", err)
+	}
+}
+
+func TestClientIdentityStripsRemoteAddrPort(t *testing.T) {
+	if got := clientIdentity("", "10.0.0.1:54321"); got != "10.0.0.1" {
+		t.Fatalf("clientIdentity(\"\", ...): got %q, want %q", got, "10.0.0.1")
+	}
+
+	if got := clientIdentity("verified-identity", "10.0.0.1:54321"); got != "verified-identity" {
+		t.Fatalf("clientIdentity with identity: got %q, want %q", got, "verified-identity")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/api"
+	"github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+// endpointServer is the subset of pkg/net's Server that initializeEndpoints
+// needs to register routes against, plus the listener-level hook NewAgent
+// uses to actually enforce RequireMTLS.
+type endpointServer interface {
+	AddCreateEndpoint(func(*mux.Router) error) error
+	SetCreateEndpoint(string, func(*mux.Router) error) error
+	Address() string
+
+	// UseTLSConfig applies tlsConfig to the server's listener, so
+	// RequireAndVerifyClientCert is actually enforced at the transport layer
+	// instead of merely being checked for by VerifyPeerCertificate.
+	UseTLSConfig(tlsConfig *tls.Config) error
+}
+
+// gpuSet is the subset of pkg/gpu's GpuSet that the agent needs: reporting
+// its full inventory for /v1/status and /v1/register/session, and selecting
+// a subset of it for a session started directly against this agent.
+type gpuSet interface {
+	GetGpus() []api.Gpu
+	Select(pciIds []string, memoryPerGpu uint64) (*gpu.SelectedGpuSet, error)
+}
+
+const (
+	// eventBusBufferSize is the minimum per-subscriber channel depth for GET
+	// /v1/events before the oldest buffered event is dropped; a subscriber
+	// replaying a longer backlog via Last-Event-ID gets a deeper channel.
+	eventBusBufferSize = 32
+
+	// eventBusHistoryCap bounds how far back a reconnecting subscriber can
+	// replay via Last-Event-ID.
+	eventBusHistoryCap = 256
+)
+
+// AgentConfig bundles the settings NewAgent needs beyond its transport and
+// GPU inventory: session limits and deadlines, draining, admission policy
+// and the agent's controller<->agent auth.
+type AgentConfig struct {
+	Hostname    string
+	MaxSessions int
+	JuicePath   string
+
+	// SessionDeadlines is applied to every connection accepted by a session
+	// started directly against this agent.
+	SessionDeadlines SessionDeadlines
+
+	// ConnectionIdleTimeout bounds how long a WebSocket-tunneled session
+	// connection may sit idle before it's dropped as a keepalive failure.
+	ConnectionIdleTimeout time.Duration
+
+	// DrainDeadline is how long Drain lets a session's existing connections
+	// run before cancelling it outright.
+	DrainDeadline time.Duration
+
+	Admission AdmissionLimits
+
+	RequireMTLS bool
+	CertPath    string
+	KeyPath     string
+	CACertPath  string
+
+	// SigningKeyId/SigningKey seed the agent's own JwksSigner, used to mint
+	// tokens for sessions it creates directly via /v1/request/session.
+	SigningKeyId string
+	SigningKey   []byte
+}
+
+// Agent is the per-host process that owns a set of GPUs and the sessions
+// running against them.
+type Agent struct {
+	Id       string
+	Hostname string
+
+	Server endpointServer
+	Gpus   gpuSet
+
+	maxSessions           int
+	sessions              *utilities.ConcurrentMap[string, *Session]
+	juicePath             string
+	sessionDeadlines      SessionDeadlines
+	connectionIdleTimeout time.Duration
+	drainDeadline         time.Duration
+	draining              *utilities.ConcurrentVariable[bool]
+
+	httpClient *http.Client
+
+	auth          *pkgnet.Authenticator
+	admission     *AdmissionController
+	events        *task.EventBus
+	eventListener EventListener
+
+	taskManager *task.TaskManager
+}
+
+// NewAgent wires the agent's controller<->agent authentication: an mTLS
+// requirement on inbound controller calls plus a session-token signer and
+// verifier sharing the same rotatable key set, so tokens this agent mints
+// for /v1/request/session also verify on its own /v1/connect/session/{id}.
+// ctx bounds the agent's own taskManager, and therefore every session it
+// starts directly via /v1/request/session.
+func NewAgent(ctx context.Context, id string, config AgentConfig, server endpointServer, gpus gpuSet, httpClient *http.Client) (*Agent, error) {
+	signer := pkgnet.NewJwksSigner()
+	verifier := pkgnet.NewJwksVerifier()
+
+	if config.SigningKeyId != "" {
+		signer.Rotate(config.SigningKeyId, config.SigningKey)
+		verifier.Rotate(signer.Keys())
+	}
+
+	if config.RequireMTLS {
+		tlsConfig, err := pkgnet.NewMTLSConfig(config.CertPath, config.KeyPath, config.CACertPath)
+		if err != nil {
+			return nil, errors.New("unable to configure controller mTLS").Wrap(err)
+		}
+
+		if err := server.UseTLSConfig(tlsConfig); err != nil {
+			return nil, errors.New("unable to apply controller mTLS to the agent's listener").Wrap(err)
+		}
+	}
+
+	events := task.NewEventBus(eventBusBufferSize, eventBusHistoryCap)
+
+	return &Agent{
+		Id:                    id,
+		Hostname:              config.Hostname,
+		Server:                server,
+		Gpus:                  gpus,
+		maxSessions:           config.MaxSessions,
+		sessions:              utilities.NewConcurrentMap[string, *Session](),
+		juicePath:             config.JuicePath,
+		sessionDeadlines:      config.SessionDeadlines,
+		connectionIdleTimeout: config.ConnectionIdleTimeout,
+		drainDeadline:         config.DrainDeadline,
+		draining:              utilities.NewConcurrentVariableD[bool](false),
+		httpClient:            httpClient,
+		auth:                  pkgnet.NewAuthenticator(config.RequireMTLS, verifier, signer),
+		admission:             NewAdmissionController(config.Admission),
+		events:                events,
+		eventListener:         newBusEventListener(events),
+		taskManager:           task.NewTaskManager(ctx),
+	}, nil
+}
+
+// Draining reports whether Drain has been called on the agent, which
+// getStatusEp reports as api.StateDraining. requestSessionEp does not check
+// it, so a draining agent still accepts new sessions requested directly.
+func (agent *Agent) Draining() bool {
+	return utilities.WithReturn(agent.draining, func(value bool) bool {
+		return value
+	})
+}
+
+// Drain marks the agent itself as draining, for getStatusEp to report via
+// api.StateDraining; it does not drain any session directly; callers drain
+// each session (see drainEp).
+func (agent *Agent) Drain() {
+	agent.draining.Set(true)
+}
+
+// drainSession starts session draining and, for a Persistent session, first
+// migrates it to the controller so it can be re-registered on another agent
+// instead of simply being cut off once this agent finishes draining.
+func (agent *Agent) drainSession(session *Session) {
+	if session.Persistent {
+		if err := agent.migrateSession(session); err != nil {
+			logger.Error(errors.New("unable to migrate session during drain").Wrap(err))
+		}
+	}
+
+	session.Drain(agent.drainDeadline)
+}
+
+// migrateSession hands a Persistent session off to the controller by
+// POSTing its exported state to /v1/register/session at the controller's
+// URL, so the controller can re-register it on another agent, the same way
+// it registers a brand new session, once this one finishes draining.
+func (agent *Agent) migrateSession(session *Session) error {
+	return pkgnet.PostWithBodyNoResponse[restapi.Session](agent.httpClient, getUrlString("/v1/register/session"), session.ExportForMigration())
+}
+
+// releaseOnClose wraps an EventListener to additionally give back the
+// fair-share admission quota a session consumed once it closes, mirroring
+// the existing session.gpus.Release() call in Session.Run's close path.
+// Without this, every admitted session would permanently hold its quota and
+// requestSessionEp would eventually reject everything regardless of how
+// many sessions are actually still running.
+type releaseOnClose struct {
+	EventListener
+	admission    *AdmissionController
+	pciIds       []string
+	memoryPerGpu uint64
+}
+
+func (listener *releaseOnClose) SessionClosed(sessionId string) {
+	listener.admission.Release(listener.pciIds, listener.memoryPerGpu)
+	listener.EventListener.SessionClosed(sessionId)
+}
+
+// startSession selects the requested GPUs and starts a new, non-persistent
+// session directly against this agent, for POST /v1/request/session callers
+// that never go through the controller's /v1/register/session path.
+func (agent *Agent) startSession(requestSession api.RequestSession) (*Session, error) {
+	selectedGpus, err := agent.Gpus.Select(requestSession.Gpus, requestSession.GpuMemory)
+	if err != nil {
+		return nil, errors.Newf("unable to select GPUs %v", requestSession.Gpus).Wrap(err)
+	}
+
+	id := uuid.NewString()
+
+	listener := &releaseOnClose{
+		EventListener: agent.eventListener,
+		admission:     agent.admission,
+		pciIds:        requestSession.Gpus,
+		memoryPerGpu:  requestSession.GpuMemory,
+	}
+
+	session := newSession(agent.taskManager.Ctx(), id, requestSession.Version, false, agent.juicePath, selectedGpus, agent.sessionDeadlines, listener)
+
+	agent.sessions.Set(id, session)
+
+	agent.taskManager.GoFn(fmt.Sprintf("session %s", id), session.Run)
+
+	return session, nil
+}
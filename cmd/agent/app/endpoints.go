@@ -4,12 +4,16 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/prometheus"
 	"github.com/Juice-Labs/Juice-Labs/internal/build"
@@ -22,13 +26,41 @@ import (
 
 const (
 	RequestSessionName = "RequestSession"
+
+	// sessionTokenTTL is how long a session token minted directly by this
+	// agent (for sessions created via /v1/request/session rather than
+	// registered from the controller) stays valid.
+	sessionTokenTTL = 12 * time.Hour
 )
 
+// requestSessionResponse is returned from /v1/request/session so the caller
+// has a session token to present on /v1/connect/session/{id}.
+type requestSessionResponse struct {
+	Id    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// sessionUpgrader upgrades /v1/connect/session/{id} to a WebSocket when the
+// caller sends Upgrade: websocket, so the session tunnel survives HTTP/2 and
+// reverse proxies that don't support Hijack (nginx, Caddy, most cloud LBs).
+// A proxy sitting in front of the agent must forward the Connection, Upgrade
+// and Sec-WebSocket-* headers unmodified for this path to work.
+var sessionUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+var eventsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 func (agent *Agent) initializeEndpoints() {
 	agent.Server.AddCreateEndpoint(agent.getStatusEp)
 	agent.Server.SetCreateEndpoint(RequestSessionName, agent.requestSessionEp)
 	agent.Server.AddCreateEndpoint(agent.getSessionEp)
 	agent.Server.AddCreateEndpoint(agent.connectSessionEp)
+	agent.Server.AddCreateEndpoint(agent.getEventsEp)
+	agent.Server.AddCreateEndpoint(agent.drainSessionEp)
+	agent.Server.AddCreateEndpoint(agent.drainEp)
 
 	prometheus.InitializeEndpoints(agent.Server)
 }
@@ -36,9 +68,14 @@ func (agent *Agent) initializeEndpoints() {
 func (agent *Agent) getStatusEp(router *mux.Router) error {
 	router.Methods("GET").Path("/v1/status").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			state := api.StateActive
+			if agent.Draining() {
+				state = api.StateDraining
+			}
+
 			err := pkgnet.Respond(w, http.StatusOK, api.Agent{
 				Id:          agent.Id,
-				State:       api.StateActive,
+				State:       state,
 				Version:     build.Version,
 				Hostname:    agent.Hostname,
 				Address:     agent.Server.Address(),
@@ -61,10 +98,20 @@ func (agent *Agent) requestSessionEp(router *mux.Router) error {
 
 			requestSession, err := pkgnet.ReadRequestBody[api.RequestSession](r)
 			if err == nil {
-				// TODO: Verify version
-
-				if agent.sessions.Len()+1 >= agent.maxSessions {
+				if requestSession.Version != build.Version {
+					versionErr := fmt.Errorf("requested version %s does not match agent version %s", requestSession.Version, build.Version)
+					err = errors.Join(versionErr, pkgnet.RespondWithString(w, http.StatusBadRequest, versionErr.Error()))
+				} else if agent.sessions.Len()+1 >= agent.maxSessions {
 					err = errors.New("unable to add another session")
+				} else if admissionErr, retryAfter := agent.admission.Allow(clientIdentity("", r.RemoteAddr), requestSession.Gpus, requestSession.GpuMemory); admissionErr != nil {
+					status := http.StatusTooManyRequests
+					if admissionErr == ErrFairShareExceeded {
+						status = http.StatusConflict
+					} else if retryAfter > 0 {
+						w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
+					}
+
+					err = errors.Join(admissionErr, pkgnet.RespondWithString(w, status, admissionErr.Error()))
 				}
 			} else {
 				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
@@ -83,7 +130,22 @@ func (agent *Agent) requestSessionEp(router *mux.Router) error {
 				return
 			}
 
-			err = pkgnet.RespondWithString(w, http.StatusOK, createdSession.Id)
+			// A session created directly against this agent (as opposed to
+			// one registered from the controller) has no controller-signed
+			// token yet, so the agent mints its own and hands it back to
+			// the caller for use on /v1/connect/session/{id}.
+			token, err := agent.auth.IssueSessionToken(createdSession.Id, requestSession.Gpus, requestSession.Version, sessionTokenTTL)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				logger.Error(err)
+				err = errors.Join(err, createdSession.Signal())
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, requestSessionResponse{
+				Id:    createdSession.Id,
+				Token: token,
+			})
 			if err != nil {
 				err = errors.Join(err, createdSession.Signal())
 
@@ -96,6 +158,12 @@ func (agent *Agent) requestSessionEp(router *mux.Router) error {
 func (agent *Agent) registerSessionEp(router *mux.Router) error {
 	router.Methods("POST").Path("/v1/register/session").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			if err := agent.auth.VerifyController(r); err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusUnauthorized, err.Error()))
+				logger.Error(err)
+				return
+			}
+
 			session, err := pkgnet.ReadRequestBody[api.Session](r)
 			if err != nil {
 				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
@@ -103,8 +171,6 @@ func (agent *Agent) registerSessionEp(router *mux.Router) error {
 				return
 			}
 
-			// TODO: verify it came from the controller
-
 			err = agent.registerSession(session)
 			if err != nil {
 				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
@@ -153,6 +219,16 @@ func (agent *Agent) connectSessionEp(router *mux.Router) error {
 		func(w http.ResponseWriter, r *http.Request) {
 			id := mux.Vars(r)["id"]
 
+			claims, err := agent.auth.VerifySessionToken(r)
+			if err == nil && claims.SessionId != id {
+				err = fmt.Errorf("session token for %s is not valid for session %s", claims.SessionId, id)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusUnauthorized, err.Error()))
+				logger.Error(err)
+				return
+			}
+
 			session, err := agent.getSession(id)
 			if err == nil {
 				if session == nil {
@@ -169,27 +245,185 @@ func (agent *Agent) connectSessionEp(router *mux.Router) error {
 
 			var conn net.Conn
 
-			hijacker, err := utilities.Cast[http.Hijacker](w)
-			if err == nil {
-				conn, _, err = hijacker.Hijack()
-				if err != nil {
-					err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+			if websocket.IsWebSocketUpgrade(r) {
+				ws, upgradeErr := sessionUpgrader.Upgrade(w, r, nil)
+				if upgradeErr != nil {
+					logger.Error(errors.Join(upgradeErr, pkgnet.RespondWithString(w, http.StatusInternalServerError, upgradeErr.Error())))
+					return
 				}
+
+				conn = pkgnet.NewWebsocketConn(ws, agent.connectionIdleTimeout)
 			} else {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				hijacker, castErr := utilities.Cast[http.Hijacker](w)
+				if castErr == nil {
+					conn, _, err = hijacker.Hijack()
+					if err != nil {
+						err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+					}
+				} else {
+					err = errors.Join(castErr, pkgnet.RespondWithString(w, http.StatusInternalServerError, castErr.Error()))
+				}
+
+				if err != nil {
+					logger.Error(err)
+					return
+				}
 			}
 
+			err = session.Connect(conn)
 			if err != nil {
+				err = errors.Join(err, conn.Close())
+
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// getEventsEp streams session.created, session.closed, connection.created
+// and connection.closed lifecycle events as Server-Sent Events, or as a
+// WebSocket when the caller sends Upgrade: websocket. A client reconnecting
+// with Last-Event-ID replays any events it missed since that Id, up to the
+// bus's retained history.
+// getEventsEp streams session and connection lifecycle events, including
+// pids and process names, so it is gated the same way registerSessionEp is:
+// controller-only.
+func (agent *Agent) getEventsEp(router *mux.Router) error {
+	router.Methods("GET").Path("/v1/events").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := agent.auth.VerifyController(r); err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusUnauthorized, err.Error()))
 				logger.Error(err)
 				return
 			}
 
-			err = session.Connect(conn)
+			lastEventId, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+			events, unsubscribe := agent.events.Subscribe(lastEventId)
+			defer unsubscribe()
+
+			ctx := r.Context()
+
+			if websocket.IsWebSocketUpgrade(r) {
+				ws, err := eventsUpgrader.Upgrade(w, r, nil)
+				if err != nil {
+					logger.Error(err)
+					return
+				}
+				defer ws.Close()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+
+					case event, ok := <-events:
+						if !ok {
+							return
+						}
+						if err := ws.WriteJSON(event); err != nil {
+							logger.Error(err)
+							return
+						}
+					}
+				}
+			}
+
+			flusher, err := utilities.Cast[http.Flusher](w)
 			if err != nil {
-				err = errors.Join(err, conn.Close())
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
 
+			for {
+				select {
+				case <-ctx.Done():
+					return
+
+				case event, ok := <-events:
+					if !ok {
+						return
+					}
+
+					data, err := json.Marshal(event.Data)
+					if err != nil {
+						logger.Error(err)
+						continue
+					}
+
+					if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Name, data); err != nil {
+						logger.Error(err)
+						return
+					}
+					flusher.Flush()
+				}
+			}
+		})
+	return nil
+}
+
+// drainSessionEp marks a single session as draining: it stops accepting new
+// Connect calls but lets connections already open run until deadline.
+// Controller-only, like registerSessionEp: it lets any caller take a
+// session out of service.
+func (agent *Agent) drainSessionEp(router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/drain").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := agent.auth.VerifyController(r); err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusUnauthorized, err.Error()))
 				logger.Error(err)
+				return
 			}
+
+			id := mux.Vars(r)["id"]
+
+			session, err := agent.getSession(id)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				logger.Error(err)
+				return
+			}
+			if session == nil {
+				pkgnet.RespondEmpty(w, http.StatusBadRequest)
+				return
+			}
+
+			agent.drainSession(session)
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
+
+// drainEp marks every session on the agent as draining, for use ahead of a
+// planned shutdown or upgrade so load balancers stop routing new requests
+// here once getStatusEp reports api.StateDraining. Controller-only, like
+// registerSessionEp: it lets any caller take the whole agent out of
+// service.
+func (agent *Agent) drainEp(router *mux.Router) error {
+	router.Methods("POST").Path("/v1/drain").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := agent.auth.VerifyController(r); err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusUnauthorized, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			agent.Drain()
+
+			agent.sessions.Foreach(func(id string, session *Session) bool {
+				agent.drainSession(session)
+				return true
+			})
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
 		})
 	return nil
 }
@@ -0,0 +1,70 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// sessionCreatedEvent, sessionClosedEvent, connectionCreatedEvent and
+// connectionClosedEvent are the JSON bodies published on the event bus for
+// the matching EventListener callback, so subscribers to GET /v1/events see
+// the same lifecycle the agent tracks internally without polling /v1/status.
+type sessionCreatedEvent struct {
+	SessionId string `json:"sessionId"`
+}
+
+type sessionClosedEvent struct {
+	SessionId string `json:"sessionId"`
+}
+
+type connectionCreatedEvent struct {
+	SessionId string                 `json:"sessionId"`
+	Pid       string                 `json:"pid"`
+	Process   string                 `json:"process"`
+	Data      restapi.ConnectionData `json:"connection"`
+}
+
+type connectionClosedEvent struct {
+	SessionId string                 `json:"sessionId"`
+	Data      restapi.ConnectionData `json:"connection"`
+	ExitCode  int                    `json:"exitCode"`
+}
+
+// busEventListener adapts Session's EventListener callbacks onto an
+// *task.EventBus, so dashboards and the controller can observe session and
+// connection lifecycle via GET /v1/events instead of polling /v1/status.
+type busEventListener struct {
+	bus *task.EventBus
+}
+
+func newBusEventListener(bus *task.EventBus) *busEventListener {
+	return &busEventListener{bus: bus}
+}
+
+func (listener *busEventListener) SessionCreated(sessionId string) {
+	listener.bus.Publish("session.created", sessionCreatedEvent{SessionId: sessionId})
+}
+
+func (listener *busEventListener) SessionClosed(sessionId string) {
+	listener.bus.Publish("session.closed", sessionClosedEvent{SessionId: sessionId})
+}
+
+func (listener *busEventListener) ConnectionCreated(sessionId string, data restapi.ConnectionData) {
+	listener.bus.Publish("connection.created", connectionCreatedEvent{
+		SessionId: sessionId,
+		Pid:       data.Pid,
+		Process:   data.ProcessName,
+		Data:      data,
+	})
+}
+
+func (listener *busEventListener) ConnectionClosed(sessionId string, data restapi.ConnectionData, exitCode int) {
+	listener.bus.Publish("connection.closed", connectionClosedEvent{
+		SessionId: sessionId,
+		Data:      data,
+		ExitCode:  exitCode,
+	})
+}
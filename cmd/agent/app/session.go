@@ -12,15 +12,45 @@ import (
 	"github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
 )
 
 var (
-	ErrClosed = errors.New("session is closed")
+	ErrClosed   = errors.New("session is closed")
+	ErrDraining = errors.New("session is draining and no longer accepting new connections")
 )
 
+// SessionDeadlines configures the idle/read/write deadlines applied to every
+// connection a session accepts, so a stuck client can't hold a GPU slot
+// indefinitely. A zero duration disables the corresponding deadline. Each
+// deadline is set once, measured from when Connect wraps the connection;
+// activity on the connection does not extend it, and reaching it closes the
+// connection.
+type SessionDeadlines struct {
+	Idle  time.Duration
+	Read  time.Duration
+	Write time.Duration
+}
+
+// deadlineCanceler unblocks any in-flight IO immediately. Implemented by the
+// *deadlineConn wrapper returned from pkg/net.NewDeadlineConn.
+type deadlineCanceler interface {
+	Cancel()
+}
+
+// EventListener receives session and connection lifecycle callbacks from a
+// running Session, so the agent can publish them (e.g. onto an event bus for
+// GET /v1/events) without Session depending on how they're delivered.
+type EventListener interface {
+	SessionCreated(sessionId string)
+	SessionClosed(sessionId string)
+	ConnectionCreated(sessionId string, data restapi.ConnectionData)
+	ConnectionClosed(sessionId string, data restapi.ConnectionData, exitCode int)
+}
+
 type Session struct {
 	Id         string
 	Version    string
@@ -28,9 +58,12 @@ type Session struct {
 
 	juicePath string
 	gpus      *gpu.SelectedGpuSet
+	deadlines SessionDeadlines
 
 	closed             *utilities.ConcurrentVariable[bool]
+	draining           *utilities.ConcurrentVariable[bool]
 	connections        *utilities.ConcurrentMap[string, *Connection]
+	connDeadlines      *utilities.ConcurrentMap[string, deadlineCanceler]
 	connectionsChanged chan struct{}
 	sessionClosing     chan struct{}
 
@@ -39,15 +72,18 @@ type Session struct {
 	eventListener EventListener
 }
 
-func newSession(ctx context.Context, id string, version string, persistent bool, juicePath string, gpus *gpu.SelectedGpuSet, eventListener EventListener) *Session {
+func newSession(ctx context.Context, id string, version string, persistent bool, juicePath string, gpus *gpu.SelectedGpuSet, deadlines SessionDeadlines, eventListener EventListener) *Session {
 	return &Session{
 		Id:                 id,
 		Version:            version,
 		Persistent:         persistent,
 		juicePath:          juicePath,
 		gpus:               gpus,
+		deadlines:          deadlines,
 		closed:             utilities.NewConcurrentVariableD[bool](false),
+		draining:           utilities.NewConcurrentVariableD[bool](false),
 		connections:        utilities.NewConcurrentMap[string, *Connection](),
+		connDeadlines:      utilities.NewConcurrentMap[string, deadlineCanceler](),
 		connectionsChanged: make(chan struct{}),
 		sessionClosing:     make(chan struct{}),
 		taskManager:        task.NewTaskManager(ctx),
@@ -71,6 +107,10 @@ func (session *Session) Session() restapi.Session {
 
 			gpus = session.gpus.GetGpus()
 			state = restapi.SessionActive
+
+			if session.Draining() {
+				state = restapi.SessionDraining
+			}
 		}
 
 		return restapi.Session{
@@ -85,6 +125,8 @@ func (session *Session) Session() restapi.Session {
 }
 
 func (session *Session) Run(group task.Group) error {
+	session.eventListener.SessionCreated(session.Id)
+
 	group.GoFn(fmt.Sprintf("session %s close", session.Id), func(g task.Group) error {
 		select {
 		case <-group.Ctx().Done():
@@ -124,14 +166,38 @@ func (session *Session) Run(group task.Group) error {
 					session.Cancel()
 
 				case <-session.connectionsChanged:
+					// While draining, an empty connection set means the
+					// session has nothing left to wait for; cancel
+					// immediately instead of waiting out the idle ticker.
 					if session.connections.Empty() {
-						ticker.Reset(30 * time.Second)
+						if session.Draining() {
+							session.Cancel()
+						} else {
+							ticker.Reset(30 * time.Second)
+						}
 					} else {
 						ticker.Stop()
 					}
 				}
 			}
 
+			return nil
+		})
+	} else {
+		group.GoFn(fmt.Sprintf("session %s drain watch", session.Id), func(g task.Group) error {
+			done := false
+			for !done {
+				select {
+				case <-session.sessionClosing:
+					done = true
+
+				case <-session.connectionsChanged:
+					if session.Draining() && session.connections.Empty() {
+						session.Cancel()
+					}
+				}
+			}
+
 			return nil
 		})
 	}
@@ -142,18 +208,86 @@ func (session *Session) Run(group task.Group) error {
 func (session *Session) Cancel() {
 	utilities.With(session.closed, func(value bool) {
 		if !value {
+			session.connDeadlines.Foreach(func(key string, value deadlineCanceler) bool {
+				value.Cancel()
+				return true
+			})
+
 			session.taskManager.Cancel()
 		}
 	})
 }
 
+// Draining reports whether the session is refusing new Connect calls while
+// letting existing connections run to completion.
+func (session *Session) Draining() bool {
+	return utilities.WithReturn(session.draining, func(value bool) bool {
+		return value
+	})
+}
+
+// Drain marks the session as draining: new Connect calls for connection ids
+// it hasn't already seen are rejected with ErrDraining, while in-flight
+// connections run to completion. If the session still has connections open
+// once deadline elapses, it is cancelled outright.
+func (session *Session) Drain(deadline time.Duration) {
+	session.draining.Set(true)
+
+	session.taskManager.GoFn(fmt.Sprintf("session %s drain", session.Id), func(g task.Group) error {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+
+		// sessionClosing is only closed after taskManager.Wait returns, which
+		// waits for this task, so the task also ends on the taskManager's
+		// own cancellation.
+		select {
+		case <-session.sessionClosing:
+		case <-session.taskManager.Ctx().Done():
+		case <-timer.C:
+			session.Cancel()
+		}
+
+		return nil
+	})
+}
+
+// ExportForMigration captures everything a different agent needs to
+// re-register this Persistent session via POST /v1/register/session,
+// letting the controller move it off an agent that is draining. This
+// includes juicePath, which the plain status payload from Session() drops,
+// since the destination agent needs it to resume the same client binary.
+func (session *Session) ExportForMigration() restapi.Session {
+	exported := session.Session()
+	exported.JuicePath = session.juicePath
+	return exported
+}
+
 func (session *Session) Connect(connectionData restapi.ConnectionData, c net.Conn) error {
 	logger.Tracef("Connecting to connection: %s", connectionData.Id)
 
+	deadlineConn := pkgnet.NewDeadlineConn(c)
+	if canceler, ok := deadlineConn.(deadlineCanceler); ok {
+		session.connDeadlines.Set(connectionData.Id, canceler)
+	}
+	if session.deadlines.Idle > 0 {
+		_ = deadlineConn.SetDeadline(time.Now().Add(session.deadlines.Idle))
+	}
+	if session.deadlines.Read > 0 {
+		_ = deadlineConn.SetReadDeadline(time.Now().Add(session.deadlines.Read))
+	}
+	if session.deadlines.Write > 0 {
+		_ = deadlineConn.SetWriteDeadline(time.Now().Add(session.deadlines.Write))
+	}
+	c = deadlineConn
+
 	return utilities.WithReturn(session.closed, func(value bool) error {
 		if !value {
 			connection, found := session.connections.Get(connectionData.Id)
 			if !found {
+				if session.Draining() {
+					return ErrDraining
+				}
+
 				var err error
 				connection, err = session.addConnection(connectionData)
 				if err != nil {
@@ -187,6 +321,7 @@ func (session *Session) addConnection(connectionData restapi.ConnectionData) (*C
 		close(exitCodeCh)
 
 		session.connections.Delete(connection.Id)
+		session.connDeadlines.Delete(connection.Id)
 		session.connectionsChanged <- struct{}{}
 
 		session.eventListener.ConnectionClosed(session.Id, connection.ConnectionData, exitCode)
@@ -0,0 +1,312 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/errors"
+)
+
+var (
+	ErrTokenExpired   = errors.New("session token has expired")
+	ErrTokenInvalid   = errors.New("session token is invalid")
+	ErrVersionPinned  = errors.New("session token version does not match caller version")
+	ErrPeerUnverified = errors.New("peer connection did not present a verified client certificate")
+)
+
+// SessionClaims is the set of claims carried by a signed session token. The
+// controller issues these, as does an agent for a session created directly
+// against it via /v1/request/session, and the agent verifies them on
+// /v1/connect/session/{id}. Verify checks the signature and expiry only;
+// AllowedPciIds and Version are carried but not checked against the request.
+type SessionClaims struct {
+	SessionId     string
+	AllowedPciIds []string
+	Version       string
+	ExpiresAt     time.Time
+}
+
+func (claims SessionClaims) Valid() error {
+	if time.Now().After(claims.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// TokenSigner issues signed session tokens. The controller holds one, and so
+// does an agent, to mint tokens for sessions created directly against it.
+type TokenSigner interface {
+	Sign(claims SessionClaims) (string, error)
+}
+
+// TokenVerifier verifies a signed session token and recovers its claims. An
+// agent's verifier is seeded by NewAgent with the same key as the agent's own
+// signer; it does not fetch keys from the controller.
+type TokenVerifier interface {
+	Verify(token string) (SessionClaims, error)
+}
+
+// NewMTLSConfig builds a *tls.Config that requires and verifies a client
+// certificate signed by caCertPath, for use on the controller<->agent
+// listener and client transports.
+func NewMTLSConfig(certPath string, keyPath string, caCertPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, errors.Newf("unable to load certificate pair %s, %s", certPath, keyPath).Wrap(err)
+	}
+
+	caCertPem, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, errors.Newf("unable to read CA certificate %s", caCertPath).Wrap(err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCertPem) {
+		return nil, errors.Newf("unable to parse CA certificate %s", caCertPath)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caCertPool,
+		RootCAs:      caCertPool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// VerifyPeerCertificate returns an error unless the request arrived over a
+// TLS connection that presented at least one verified client certificate,
+// i.e. it terminated against a tls.Config built with NewMTLSConfig.
+func VerifyPeerCertificate(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ErrPeerUnverified
+	}
+	return nil
+}
+
+// Authenticator is the agent-side entry point for controller<->agent auth.
+// It requires the controller connection to have presented a verified mTLS
+// client certificate and, where a session token is expected, verifies it
+// against the configured TokenVerifier.
+type Authenticator struct {
+	RequireMTLS bool
+	Verifier    TokenVerifier
+
+	// Signer mints session tokens for sessions created directly against the
+	// agent via /v1/request/session, as opposed to sessions registered from
+	// the controller that already carry a controller-signed token.
+	// IssueSessionToken fails when it is nil.
+	Signer TokenSigner
+}
+
+func NewAuthenticator(requireMTLS bool, verifier TokenVerifier, signer TokenSigner) *Authenticator {
+	return &Authenticator{
+		RequireMTLS: requireMTLS,
+		Verifier:    verifier,
+		Signer:      signer,
+	}
+}
+
+// IssueSessionToken mints a session token for a session this agent just
+// created locally, so the caller can use it to authenticate subsequent
+// /v1/connect/session/{id} calls for that session.
+func (auth *Authenticator) IssueSessionToken(sessionId string, allowedPciIds []string, version string, ttl time.Duration) (string, error) {
+	if auth.Signer == nil {
+		return "", errors.New("authenticator has no signer configured")
+	}
+
+	return auth.Signer.Sign(SessionClaims{
+		SessionId:     sessionId,
+		AllowedPciIds: allowedPciIds,
+		Version:       version,
+		ExpiresAt:     time.Now().Add(ttl),
+	})
+}
+
+// VerifyController confirms that a request claiming to come from the
+// controller did, checking the mTLS peer certificate when required.
+func (auth *Authenticator) VerifyController(r *http.Request) error {
+	if auth.RequireMTLS {
+		if err := VerifyPeerCertificate(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifySessionToken extracts and verifies the bearer session token carried
+// on the request's Authorization header.
+func (auth *Authenticator) VerifySessionToken(r *http.Request) (SessionClaims, error) {
+	if auth.Verifier == nil {
+		return SessionClaims{}, errors.New("authenticator has no verifier configured")
+	}
+
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	return auth.Verifier.Verify(token)
+}
+
+// tokenPayload is the wire form of SessionClaims: compact enough to fit in an
+// Authorization header, signed with HMAC-SHA256 under a rotatable key.
+type tokenPayload struct {
+	SessionId     string    `json:"sessionId"`
+	AllowedPciIds []string  `json:"allowedPciIds"`
+	Version       string    `json:"version"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// JwksSigner signs session tokens with the active key in a rotatable key
+// set, identifying which key it used by kid so a JwksVerifier fed the same
+// keys (even mid-rotation) can still verify it.
+type JwksSigner struct {
+	mutex     sync.RWMutex
+	activeKid string
+	keys      map[string][]byte
+}
+
+func NewJwksSigner() *JwksSigner {
+	return &JwksSigner{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Rotate adds or replaces the key identified by kid and makes it the key
+// used for new signatures. Existing keys are kept so tokens signed before
+// the rotation still verify until they expire.
+func (signer *JwksSigner) Rotate(kid string, key []byte) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+
+	signer.keys[kid] = key
+	signer.activeKid = kid
+}
+
+// Keys returns the current kid -> key set, for handing to a JwksVerifier
+// (e.g. over the controller's JWKS endpoint).
+func (signer *JwksSigner) Keys() map[string][]byte {
+	signer.mutex.RLock()
+	defer signer.mutex.RUnlock()
+
+	keys := make(map[string][]byte, len(signer.keys))
+	for kid, key := range signer.keys {
+		keys[kid] = key
+	}
+	return keys
+}
+
+func (signer *JwksSigner) Sign(claims SessionClaims) (string, error) {
+	signer.mutex.RLock()
+	kid := signer.activeKid
+	key := signer.keys[kid]
+	signer.mutex.RUnlock()
+
+	if kid == "" {
+		return "", errors.New("no active signing key")
+	}
+
+	payload, err := json.Marshal(tokenPayload{
+		SessionId:     claims.SessionId,
+		AllowedPciIds: claims.AllowedPciIds,
+		Version:       claims.Version,
+		ExpiresAt:     claims.ExpiresAt,
+	})
+	if err != nil {
+		return "", errors.New("unable to marshal session claims").Wrap(err)
+	}
+
+	payloadEncoded := base64.RawURLEncoding.EncodeToString(payload)
+	sig := signPayload(key, payloadEncoded)
+
+	return kid + "." + payloadEncoded + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func signPayload(key []byte, payloadEncoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payloadEncoded))
+	return mac.Sum(nil)
+}
+
+// JwksVerifier is a TokenVerifier backed by a set of HMAC keys, keyed by kid,
+// that can be rotated at runtime to track a JwksSigner's published keys.
+type JwksVerifier struct {
+	mutex sync.RWMutex
+	keys  map[string][]byte
+}
+
+func NewJwksVerifier() *JwksVerifier {
+	return &JwksVerifier{
+		keys: make(map[string][]byte),
+	}
+}
+
+// Rotate replaces the active key set, keyed by key id (kid). Call this
+// whenever the controller's JWKS endpoint reports a new set of keys.
+func (verifier *JwksVerifier) Rotate(keys map[string][]byte) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	verifier.keys = keys
+}
+
+func (verifier *JwksVerifier) Verify(token string) (SessionClaims, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+	kid, payloadEncoded, sigEncoded := parts[0], parts[1], parts[2]
+
+	verifier.mutex.RLock()
+	key, found := verifier.keys[kid]
+	verifier.mutex.RUnlock()
+	if !found {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigEncoded)
+	if err != nil {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	if !hmac.Equal(sig, signPayload(key, payloadEncoded)) {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(payloadEncoded)
+	if err != nil {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	var decoded tokenPayload
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return SessionClaims{}, ErrTokenInvalid
+	}
+
+	claims := SessionClaims{
+		SessionId:     decoded.SessionId,
+		AllowedPciIds: decoded.AllowedPciIds,
+		Version:       decoded.Version,
+		ExpiresAt:     decoded.ExpiresAt,
+	}
+
+	if err := claims.Valid(); err != nil {
+		return SessionClaims{}, err
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,222 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package net
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// deadlineTimer is the gonet.deadlineTimer pattern: a timer paired with a
+// cancel channel that is closed when the deadline elapses, so blocked reads
+// and writes can select on it and return immediately instead of waiting out
+// the underlying conn's own timeout (or never returning at all). onFire is
+// invoked the moment the deadline elapses or is cancelled early, so the
+// caller can close the underlying conn and actually unblock whatever
+// goroutine is parked in its Read/Write syscall, instead of merely stopping
+// our own wait on it.
+type deadlineTimer struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	cancel  chan struct{}
+	expired bool
+	onFire  func()
+}
+
+func newDeadlineTimer(onFire func()) *deadlineTimer {
+	return &deadlineTimer{
+		cancel: make(chan struct{}),
+		onFire: onFire,
+	}
+}
+
+// done returns the current cancel channel. It is closed when the deadline
+// set by setDeadline elapses.
+func (d *deadlineTimer) done() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.cancel
+}
+
+// setDeadline arms the timer for t. A zero t disables the deadline. Resetting
+// the deadline always closes the previous cancel channel and opens a fresh
+// one, so a goroutine blocked on the old channel wakes up and re-selects on
+// the new one rather than firing spuriously.
+func (d *deadlineTimer) setDeadline(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	// An expired or cancelled deadline has already closed the channel.
+	select {
+	case <-d.cancel:
+	default:
+		close(d.cancel)
+	}
+	d.cancel = make(chan struct{})
+	d.expired = false
+
+	if t.IsZero() {
+		d.timer = nil
+		return
+	}
+
+	cancel := d.cancel
+	d.timer = time.AfterFunc(time.Until(t), func() {
+		d.mutex.Lock()
+		fire := false
+		if d.cancel == cancel {
+			d.expired = true
+			close(cancel)
+			fire = true
+		}
+		d.mutex.Unlock()
+
+		if fire && d.onFire != nil {
+			d.onFire()
+		}
+	})
+}
+
+// cancelNow fires the deadline immediately, unblocking any in-flight IO.
+func (d *deadlineTimer) cancelNow() {
+	d.mutex.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	fire := false
+	select {
+	case <-d.cancel:
+	default:
+		d.expired = true
+		close(d.cancel)
+		fire = true
+	}
+	d.mutex.Unlock()
+
+	if fire && d.onFire != nil {
+		d.onFire()
+	}
+}
+
+// deadlineConn wraps a net.Conn with independent read/write deadlines backed
+// by deadlineTimer, ported from google/netstack's gonet.deadlineTimer so that
+// a stuck peer can be unblocked by cancelling the deadline channel instead of
+// relying on the wrapped conn to support SetDeadline itself.
+type deadlineConn struct {
+	net.Conn
+
+	closeOnce  sync.Once
+	readTimer  *deadlineTimer
+	writeTimer *deadlineTimer
+}
+
+// NewDeadlineConn wraps conn with cancellable read/write deadlines. A
+// deadline elapsing, or an explicit Cancel, closes the underlying conn so
+// the goroutine blocked in its Read or Write syscall actually returns
+// instead of leaking for the life of the process.
+func NewDeadlineConn(conn net.Conn) net.Conn {
+	dc := &deadlineConn{Conn: conn}
+	dc.readTimer = newDeadlineTimer(dc.closeUnderlying)
+	dc.writeTimer = newDeadlineTimer(dc.closeUnderlying)
+	return dc
+}
+
+func (conn *deadlineConn) closeUnderlying() {
+	conn.closeOnce.Do(func() {
+		_ = conn.Conn.Close()
+	})
+}
+
+func (conn *deadlineConn) Read(b []byte) (int, error) {
+	select {
+	case <-conn.readTimer.done():
+		return 0, errDeadlineExceeded("read")
+	default:
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		n, err := conn.Conn.Read(b)
+		ch <- result{n, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-conn.readTimer.done():
+		return 0, errDeadlineExceeded("read")
+	}
+}
+
+func (conn *deadlineConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.writeTimer.done():
+		return 0, errDeadlineExceeded("write")
+	default:
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		n, err := conn.Conn.Write(b)
+		ch <- result{n, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-conn.writeTimer.done():
+		return 0, errDeadlineExceeded("write")
+	}
+}
+
+func (conn *deadlineConn) SetDeadline(t time.Time) error {
+	conn.readTimer.setDeadline(t)
+	conn.writeTimer.setDeadline(t)
+	return nil
+}
+
+func (conn *deadlineConn) SetReadDeadline(t time.Time) error {
+	conn.readTimer.setDeadline(t)
+	return nil
+}
+
+func (conn *deadlineConn) SetWriteDeadline(t time.Time) error {
+	conn.writeTimer.setDeadline(t)
+	return nil
+}
+
+// Cancel unblocks any in-flight Read or Write immediately, as if both
+// deadlines had just elapsed, without waiting for a future deadline.
+func (conn *deadlineConn) Cancel() {
+	conn.readTimer.cancelNow()
+	conn.writeTimer.cancelNow()
+}
+
+type deadlineExceededError string
+
+func errDeadlineExceeded(op string) error {
+	return deadlineExceededError(op)
+}
+
+func (e deadlineExceededError) Error() string   { return e.op() + ": deadline exceeded" }
+func (e deadlineExceededError) Timeout() bool   { return true }
+func (e deadlineExceededError) Temporary() bool { return true }
+func (e deadlineExceededError) op() string      { return string(e) }
@@ -0,0 +1,74 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadlineConnExpiryClosesUnderlyingConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := NewDeadlineConn(server)
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("Read: expected a deadline-exceeded error, got nil")
+	}
+
+	// The deadline firing must have closed the underlying conn, so a write
+	// from the other end of the pipe now fails instead of blocking forever
+	// waiting for a reader that will never come back.
+	done := make(chan struct{})
+	go func() {
+		_, _ = client.Write([]byte("x"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write on the peer conn never returned; underlying conn was not closed")
+	}
+}
+
+func TestDeadlineConnCancelClosesUnderlyingConnOnce(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := NewDeadlineConn(server)
+	canceler, ok := conn.(interface{ Cancel() })
+	if !ok {
+		t.Fatal("NewDeadlineConn's result does not implement Cancel()")
+	}
+
+	// Calling Cancel twice must not panic even though both the read and
+	// write timers fire closeUnderlying independently.
+	canceler.Cancel()
+	canceler.Cancel()
+
+	// Cancel must have closed the underlying conn, so a write from the other
+	// end of the pipe fails instead of blocking forever.
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("x"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("write on the peer conn succeeded; underlying conn was not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write on the peer conn never returned; underlying conn was not closed")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package net
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPingInterval is how often wsConn pings its peer to keep intermediate
+// proxies and load balancers from reaping an otherwise idle connection.
+const wsPingInterval = 30 * time.Second
+
+// wsConn adapts a *websocket.Conn to the net.Conn interface expected by
+// Session.Connect, carrying session bytes as binary frames and translating
+// ping/pong keepalive into a configurable idle timeout.
+type wsConn struct {
+	ws          *websocket.Conn
+	idleTimeout time.Duration
+
+	reader  []byte
+	pingCh  chan struct{}
+	closeCh chan struct{}
+
+	// writeMutex serializes Write against pingLoop's keepalive pings:
+	// gorilla/websocket requires at most one concurrent writer, control
+	// frames included.
+	writeMutex sync.Mutex
+
+	// closeOnce guards against Close being entered concurrently from both
+	// the caller (e.g. an endpoint's error path) and deadlineConn.closeUnderlying
+	// firing from a background time.AfterFunc goroutine when this conn is
+	// wrapped by pkg/net.NewDeadlineConn - without it, two callers could both
+	// observe closeCh open and both call close(closeCh), panicking.
+	closeOnce sync.Once
+}
+
+// NewWebsocketConn wraps ws as a net.Conn. idleTimeout disables the keepalive
+// deadline when zero.
+func NewWebsocketConn(ws *websocket.Conn, idleTimeout time.Duration) net.Conn {
+	conn := &wsConn{
+		ws:          ws,
+		idleTimeout: idleTimeout,
+		pingCh:      make(chan struct{}, 1),
+		closeCh:     make(chan struct{}),
+	}
+
+	ws.SetPongHandler(func(string) error {
+		conn.resetDeadline()
+		return nil
+	})
+
+	if idleTimeout > 0 {
+		conn.resetDeadline()
+		go conn.pingLoop()
+	}
+
+	return conn
+}
+
+func (conn *wsConn) resetDeadline() {
+	if conn.idleTimeout > 0 {
+		_ = conn.ws.SetReadDeadline(time.Now().Add(conn.idleTimeout))
+	}
+}
+
+func (conn *wsConn) pingLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.closeCh:
+			return
+
+		case <-ticker.C:
+			conn.writeMutex.Lock()
+			err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			conn.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (conn *wsConn) Read(b []byte) (int, error) {
+	for len(conn.reader) == 0 {
+		messageType, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		if messageType == websocket.BinaryMessage {
+			conn.reader = data
+		}
+	}
+
+	n := copy(b, conn.reader)
+	conn.reader = conn.reader[n:]
+	return n, nil
+}
+
+func (conn *wsConn) Write(b []byte) (int, error) {
+	conn.writeMutex.Lock()
+	err := conn.ws.WriteMessage(websocket.BinaryMessage, b)
+	conn.writeMutex.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *wsConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		close(conn.closeCh)
+		err = conn.ws.Close()
+	})
+	return err
+}
+
+func (conn *wsConn) LocalAddr() net.Addr  { return conn.ws.LocalAddr() }
+func (conn *wsConn) RemoteAddr() net.Addr { return conn.ws.RemoteAddr() }
+
+func (conn *wsConn) SetDeadline(t time.Time) error {
+	return errors.Join(conn.ws.SetReadDeadline(t), conn.ws.SetWriteDeadline(t))
+}
+
+func (conn *wsConn) SetReadDeadline(t time.Time) error {
+	return conn.ws.SetReadDeadline(t)
+}
+
+func (conn *wsConn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.SetWriteDeadline(t)
+}
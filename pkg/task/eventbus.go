@@ -0,0 +1,110 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package task
+
+import (
+	"sync"
+)
+
+// Event is a single published occurrence, identified by a monotonically
+// increasing Id so subscribers can resume after a dropped connection via
+// Last-Event-ID.
+type Event struct {
+	Id   uint64
+	Name string
+	Data any
+}
+
+// EventBus is a buffered, per-subscriber fan-out of Events. A subscriber that
+// falls behind has its oldest buffered event dropped rather than blocking or
+// disconnecting the publisher, and a bounded ring of recent events lets a
+// reconnecting subscriber replay everything since its last seen Id.
+type EventBus struct {
+	mutex       sync.Mutex
+	nextId      uint64
+	subscribers map[uint64]chan Event
+	nextSubId   uint64
+	bufferSize  int
+
+	history    []Event
+	historyCap int
+}
+
+func NewEventBus(bufferSize int, historyCap int) *EventBus {
+	return &EventBus{
+		subscribers: make(map[uint64]chan Event),
+		bufferSize:  bufferSize,
+		historyCap:  historyCap,
+	}
+}
+
+// Publish fans name/data out to every current subscriber as a new Event.
+func (bus *EventBus) Publish(name string, data any) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.nextId++
+	event := Event{Id: bus.nextId, Name: name, Data: data}
+
+	bus.history = append(bus.history, event)
+	if len(bus.history) > bus.historyCap {
+		bus.history = bus.history[len(bus.history)-bus.historyCap:]
+	}
+
+	for _, ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Drop the oldest buffered event for this subscriber to make
+			// room, rather than blocking the publisher or this subscriber.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+// Subscribe registers a new subscriber and replays any retained events with
+// Id greater than lastEventId. The channel is made deep enough to hold the
+// whole replay, so none of it is dropped before the caller starts reading.
+// Call the returned unsubscribe func when the caller's connection ends.
+func (bus *EventBus) Subscribe(lastEventId uint64) (<-chan Event, func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.nextSubId++
+	id := bus.nextSubId
+
+	var replay []Event
+	for _, event := range bus.history {
+		if event.Id > lastEventId {
+			replay = append(replay, event)
+		}
+	}
+
+	capacity := bus.bufferSize
+	if len(replay) > capacity {
+		capacity = len(replay)
+	}
+
+	ch := make(chan Event, capacity)
+	for _, event := range replay {
+		ch <- event
+	}
+
+	bus.subscribers[id] = ch
+
+	return ch, func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+
+		delete(bus.subscribers, id)
+		close(ch)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package task
+
+import "testing"
+
+func TestEventBusFansOutToEverySubscriber(t *testing.T) {
+	bus := NewEventBus(4, 4)
+
+	chA, unsubA := bus.Subscribe(0)
+	defer unsubA()
+	chB, unsubB := bus.Subscribe(0)
+	defer unsubB()
+
+	bus.Publish("session.created", "s1")
+
+	for name, ch := range map[string]<-chan Event{"A": chA, "B": chB} {
+		select {
+		case event := <-ch:
+			if event.Name != "session.created" || event.Data != "s1" {
+				t.Fatalf("subscriber %s got %+v", name, event)
+			}
+		default:
+			t.Fatalf("subscriber %s never received the published event", name)
+		}
+	}
+}
+
+func TestEventBusSubscribeReplaysSinceLastEventId(t *testing.T) {
+	bus := NewEventBus(4, 4)
+
+	bus.Publish("a", 1)
+	bus.Publish("b", 2)
+	bus.Publish("c", 3)
+
+	ch, unsub := bus.Subscribe(1)
+	defer unsub()
+
+	var replayed []string
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-ch:
+			replayed = append(replayed, event.Name)
+		default:
+			t.Fatalf("expected a replayed event, got none after %d", i)
+		}
+	}
+
+	if replayed[0] != "b" || replayed[1] != "c" {
+		t.Fatalf("replayed = %v, want [b c]", replayed)
+	}
+}
+
+func TestEventBusUnsubscribeClosesTheChannel(t *testing.T) {
+	bus := NewEventBus(4, 4)
+
+	ch, unsub := bus.Subscribe(0)
+	unsub()
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expected the subscriber channel to be closed after unsubscribe")
+	}
+}